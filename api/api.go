@@ -16,7 +16,9 @@ package api
 
 import (
 	"slices"
+	"strings"
 
+	"github.com/google/blueprint"
 	"github.com/google/blueprint/proptools"
 
 	"android/soong/android"
@@ -57,12 +59,84 @@ type CombinedApisProperties struct {
 	Conditional_bootclasspath []string
 	// Module libraries in system server
 	System_server_classpath proptools.Configurable[[]string]
+
+	// Module libraries in the bootclasspath that contribute to the system API surface.
+	// Defaults to Bootclasspath when unset. Lets a module be part of the bootclasspath
+	// without being part of every scope, e.g. a module that only joins module-lib on a
+	// later release.
+	System_bootclasspath proptools.Configurable[[]string]
+	// Module libraries in the bootclasspath that contribute to the module-lib API surface.
+	// Defaults to Bootclasspath when unset.
+	Module_lib_bootclasspath proptools.Configurable[[]string]
+	// Module libraries in the bootclasspath that contribute to the system-server API surface.
+	// Defaults to System_server_classpath when unset.
+	System_server_bootclasspath proptools.Configurable[[]string]
+
+	// The build release this combined_apis is being built against, e.g. "S", "Tiramisu",
+	// "current". Bootclasspath members whose declared min_sdk_version is newer than this
+	// release are dropped from the per-scope lists above. Defaults to "current", which
+	// applies no filtering.
+	Build_release *string
+
+	// The api_contributions output formats to generate per scope, e.g. "signature-v5".
+	// Defaults to ["signature-v2"], matching the plain merged current.txt/removed.txt
+	// this module has always produced.
+	Formats []string
+
+	// Per-scope filegroup/module of the previous release's merged current.txt, e.g.
+	// {"public": "android.api.public.latest"}. When set for a scope, a
+	// check-compatibility:api:released pass is run between that baseline and this
+	// module's merged current.txt for the scope, and the build fails on incompatible
+	// changes.
+	Previous_api_baselines map[string]string
+
+	// Whether to generate the <name>-sdk-snapshot zip bundling the merged stubs, txts and
+	// annotations. Defaults to false, since not every combined_apis module wants the extra
+	// build work of assembling and dist'ing a snapshot.
+	Generate_sdk_snapshot *bool
+
+	// The version to stamp the generated SDK snapshot zip and its manifest with, e.g.
+	// "34" or "current". Defaults to "current". Only used when Generate_sdk_snapshot is set.
+	Snapshot_version *string
+
+	// Per-scope filegroup/module of a prior release's merged current.txt to diff this
+	// module's merged current.txt against, e.g. {"public": "android.api.public.latest"}.
+	// When set for a scope, a human-readable <scope>-api-diff.txt and machine-readable
+	// <scope>-api-diff.json are generated listing added/removed/changed API members.
+	// Scopes with no baseline configured emit no diff.
+	Diff_baselines map[string]string
+}
+
+func (a *CombinedApis) buildRelease() string {
+	return proptools.StringDefault(a.properties.Build_release, "current")
+}
+
+func (a *CombinedApis) snapshotVersion() string {
+	return proptools.StringDefault(a.properties.Snapshot_version, "current")
+}
+
+func (a *CombinedApis) formats() []string {
+	if len(a.properties.Formats) == 0 {
+		return []string{"signature-v2"}
+	}
+	return a.properties.Formats
 }
 
 type CombinedApis struct {
 	android.ModuleBase
 
 	properties CombinedApisProperties
+
+	// Names of genrule modules created in the load hook (currently just api-compatibility-check
+	// stamps) that must be wired as an actual build-time dependency of droidcore, rather than
+	// only being realized as opt-in dist artifacts.
+	droidcoreCheckModules []string
+}
+
+// droidcoreCheckDepTag marks a dependency whose output must build as part of a normal
+// droidcore/checkbuild build, e.g. an api-compatibility-check stamp.
+type droidcoreCheckDepTag struct {
+	blueprint.BaseDependencyTag
 }
 
 func init() {
@@ -100,6 +174,7 @@ func (a *CombinedApis) apiFingerprintStubDeps(ctx android.BottomUpMutatorContext
 
 func (a *CombinedApis) DepsMutator(ctx android.BottomUpMutatorContext) {
 	ctx.AddDependency(ctx.Module(), nil, a.apiFingerprintStubDeps(ctx)...)
+	ctx.AddDependency(ctx.Module(), droidcoreCheckDepTag{}, a.droidcoreCheckModules...)
 }
 
 func (a *CombinedApis) GenerateAndroidBuildActions(ctx android.ModuleContext) {
@@ -116,6 +191,16 @@ func (a *CombinedApis) GenerateAndroidBuildActions(ctx android.ModuleContext) {
 		return true
 	})
 
+	// Make the api-compatibility-check stamps an actual build-time dependency of droidcore
+	// (not just something realized via `m dist`), so an ordinary build fails on incompatible
+	// API changes instead of only `m dist` catching them.
+	var droidcoreDeps android.Paths
+	ctx.VisitDirectDepsWithTag(droidcoreCheckDepTag{}, func(dep android.Module) {
+		droidcoreDeps = append(droidcoreDeps, android.OutputFilesForModule(ctx, dep, "")...)
+	})
+	if len(droidcoreDeps) > 0 {
+		ctx.Phony("droidcore", droidcoreDeps...)
+	}
 }
 
 type genruleProps struct {
@@ -165,18 +250,175 @@ type MergedTxtDefinition struct {
 	ModuleTag string
 	// public, system, module-lib or system-server
 	Scope string
+	// The api_contributions formats to emit this merged txt in, e.g. "signature-v2",
+	// "signature-v5", "json". Defaults to ["signature-v2"] when empty.
+	Formats []string
+	// The module/filegroup of the previous release's merged current.txt for this scope.
+	// When non-empty, a check-compatibility:api:released genrule is generated alongside
+	// the merged txt. Only applies to "current.txt".
+	PreviousApiBaseline string
+	// The module/filegroup of a prior release's merged current.txt for this scope to diff
+	// against. When non-empty, <scope>-api-diff.txt and <scope>-api-diff.json are generated
+	// alongside the merged txt. Only applies to "current.txt".
+	DiffBaseline string
+}
+
+// formatMetalava maps a requested metalava-native api_contributions format to the suffix
+// appended to the merged txt's base filename and the metalava signature format flag used to
+// produce it. signature-v2 keeps the plain ".txt" suffix to match the legacy merged
+// current.txt/removed.txt names; other formats get a format-qualified suffix so they don't
+// collide with it. "json" is handled separately by createMergedJson since it's produced by the
+// api_contributions host tool rather than metalava; "proto" has no producer yet and is rejected
+// in createMergedTxtForFormat.
+var formatMetalava = map[string]struct {
+	ext  string
+	flag string
+}{
+	"signature-v2": {"txt", "v2"},
+	"signature-v5": {"v5.txt", "v5"},
+}
+
+// createMergedTxt creates txt's merged output(s) and returns the names of any genrule modules
+// it created that must be wired as a droidcore build-time dependency by the caller.
+func createMergedTxt(ctx android.LoadHookContext, txt MergedTxtDefinition, stubsTypeSuffix string, doDist bool) []string {
+	formats := txt.Formats
+	if len(formats) == 0 {
+		formats = []string{"signature-v2"}
+	}
+	for _, format := range formats {
+		createMergedTxtForFormat(ctx, txt, stubsTypeSuffix, doDist, format)
+	}
+
+	var droidcoreCheckModules []string
+	if txt.TxtFilename == "current.txt" {
+		createMergedAnnotationsZip(ctx, txt, stubsTypeSuffix, doDist)
+		if txt.PreviousApiBaseline != "" {
+			droidcoreCheckModules = append(droidcoreCheckModules, createApiCompatibilityCheck(ctx, txt, stubsTypeSuffix))
+		}
+		if txt.DiffBaseline != "" {
+			createMergedApiDiff(ctx, txt, stubsTypeSuffix)
+		}
+	}
+	return droidcoreCheckModules
 }
 
-func createMergedTxt(ctx android.LoadHookContext, txt MergedTxtDefinition, stubsTypeSuffix string, doDist bool) {
+// createApiCompatibilityCheck runs metalava in check-compatibility:api:released mode
+// between txt's merged current.txt and its configured previous release baseline, so
+// backward-incompatible changes anywhere in the merged surface fail the build instead of
+// only being caught per-module. Returns the created stamp genrule's module name so the caller
+// can wire it into droidcore as an actual build-time dependency.
+func createApiCompatibilityCheck(ctx android.LoadHookContext, txt MergedTxtDefinition, stubsTypeSuffix string) string {
 	metalavaCmd := "$(location metalava)"
 	// Silence reflection warnings. See b/168689341
 	metalavaCmd += " -J--add-opens=java.base/java.util=ALL-UNNAMED "
-	metalavaCmd += " --quiet merge-signatures --format=v2 "
+	metalavaCmd += " --quiet --source-files $(location :" + mergedTxtModuleName(ctx, txt, stubsTypeSuffix) + ") "
+	metalavaCmd += " --check-compatibility:api:released $(location :" + txt.PreviousApiBaseline + ") "
 
+	filename := mergedTxtFilename(txt)
+	stampFilename := strings.TrimSuffix(filename, ".txt") + "-compat-check.stamp"
+	moduleName := ctx.ModuleName() + stubsTypeSuffix + stampFilename
+
+	props := genruleProps{}
+	props.Name = proptools.StringPtr(moduleName)
+	props.Tools = []string{"metalava"}
+	props.Out = []string{stampFilename}
+	props.Cmd = proptools.StringPtr(metalavaCmd + "&& touch $(out)")
+	props.Srcs = proptools.NewSimpleConfigurable([]string{":" + txt.PreviousApiBaseline, ":" + mergedTxtModuleName(ctx, txt, stubsTypeSuffix)})
+	// Also dist the stamp under droidcore so `m dist` archives it; the actual build-time
+	// enforcement comes from the caller wiring moduleName into droidcore's dep graph below.
+	props.Dists = []android.Dist{
+		{
+			Targets: []string{"droidcore"},
+			Dir:     proptools.StringPtr("api-check"),
+			Dest:    proptools.StringPtr(stampFilename),
+		},
+	}
+	props.Visibility = []string{"//visibility:public"}
+	ctx.CreateModule(genrule.GenRuleFactory, &props)
+	return moduleName
+}
+
+// createMergedApiDiff runs the api_contributions host tool against txt's merged current.txt and
+// its configured diff baseline, producing a human-readable <scope>-api-diff.txt and
+// machine-readable <scope>-api-diff.json enumerating the added/removed/changed members between
+// the two, so release engineering can see how the combined surface moved across a dessert
+// release in one place. Unlike metalava's --check-compatibility modes, this always succeeds:
+// an incompatible change is a diff to report here, not a build failure (createApiCompatibilityCheck
+// is what fails the build on incompatible changes).
+func createMergedApiDiff(ctx android.LoadHookContext, txt MergedTxtDefinition, stubsTypeSuffix string) {
+	scopePrefix := ""
+	if txt.Scope != "public" {
+		scopePrefix = txt.Scope + "-"
+	}
+	txtFilename := scopePrefix + "api-diff.txt"
+	jsonFilename := scopePrefix + "api-diff.json"
+	moduleName := ctx.ModuleName() + stubsTypeSuffix + scopePrefix + "api-diff"
+
+	cmd := "$(location api_contributions) diff" +
+		" $(location :" + txt.DiffBaseline + ")" +
+		" $(location :" + mergedTxtModuleName(ctx, txt, stubsTypeSuffix) + ")" +
+		" $(genDir)/" + txtFilename +
+		" $(genDir)/" + jsonFilename
+
+	props := genruleProps{}
+	props.Name = proptools.StringPtr(moduleName)
+	props.Tools = []string{"api_contributions"}
+	props.Out = []string{txtFilename, jsonFilename}
+	props.Cmd = proptools.StringPtr(cmd)
+	props.Srcs = proptools.NewSimpleConfigurable([]string{":" + txt.DiffBaseline, ":" + mergedTxtModuleName(ctx, txt, stubsTypeSuffix)})
+	props.Dists = []android.Dist{
+		{
+			Targets: []string{"sdk", "api_txt"},
+			Dir:     proptools.StringPtr("apistubs/android/" + txt.Scope + "/diff"),
+			Dest:    proptools.StringPtr(txtFilename),
+		},
+		{
+			Targets: []string{"sdk", "api_txt"},
+			Dir:     proptools.StringPtr("apistubs/android/" + txt.Scope + "/diff"),
+			Dest:    proptools.StringPtr(jsonFilename),
+		},
+	}
+	props.Visibility = []string{"//visibility:public"}
+	ctx.CreateModule(genrule.GenRuleFactory, &props)
+}
+
+// mergedTxtFilename returns the plain-signature filename for txt, e.g. "system-current.txt".
+func mergedTxtFilename(txt MergedTxtDefinition) string {
 	filename := txt.TxtFilename
 	if txt.Scope != "public" {
 		filename = txt.Scope + "-" + filename
 	}
+	return filename
+}
+
+// mergedTxtModuleName returns the name of the signature-v2 merged txt genrule for txt, so
+// sibling genrules (compat check, api diff) can depend on it.
+func mergedTxtModuleName(ctx android.LoadHookContext, txt MergedTxtDefinition, stubsTypeSuffix string) string {
+	return ctx.ModuleName() + stubsTypeSuffix + mergedTxtFilename(txt)
+}
+
+func createMergedTxtForFormat(ctx android.LoadHookContext, txt MergedTxtDefinition, stubsTypeSuffix string, doDist bool, format string) {
+	if format == "json" {
+		createMergedJson(ctx, txt, stubsTypeSuffix)
+		return
+	}
+
+	spec, ok := formatMetalava[format]
+	if !ok {
+		ctx.ModuleErrorf("combined_apis: unsupported format %q", format)
+		return
+	}
+
+	metalavaCmd := "$(location metalava)"
+	// Silence reflection warnings. See b/168689341
+	metalavaCmd += " -J--add-opens=java.base/java.util=ALL-UNNAMED "
+	metalavaCmd += " --quiet merge-signatures --format=" + spec.flag + " "
+
+	base := strings.TrimSuffix(txt.TxtFilename, ".txt")
+	filename := base + "." + spec.ext
+	if txt.Scope != "public" {
+		filename = txt.Scope + "-" + filename
+	}
 	moduleName := ctx.ModuleName() + stubsTypeSuffix + filename
 
 	props := genruleProps{}
@@ -186,7 +428,9 @@ func createMergedTxt(ctx android.LoadHookContext, txt MergedTxtDefinition, stubs
 	props.Cmd = proptools.StringPtr(metalavaCmd + "$(in) --out $(out)")
 	props.Srcs = proptools.NewSimpleConfigurable([]string{txt.BaseTxt})
 	props.Srcs.Append(createSrcs(txt.Modules, txt.ModuleTag))
-	if doDist {
+	// Only the default signature-v2 output is dist'd under the legacy names; additional
+	// formats are consumed directly as module outputs (e.g. by SDK snapshot tooling).
+	if doDist && format == "signature-v2" {
 		props.Dists = []android.Dist{
 			{
 				Targets: []string{"droidcore"},
@@ -204,6 +448,70 @@ func createMergedTxt(ctx android.LoadHookContext, txt MergedTxtDefinition, stubs
 	ctx.CreateModule(genrule.GenRuleFactory, &props)
 }
 
+// createMergedJson merges txt's contributing modules into a single signature-v2 txt (via
+// metalava, same as the plain "signature-v2" format) and then walks it with the api_contributions
+// host tool into {package,class,members:[{kind,name,signature,since,deprecated}]} json records.
+// metalava itself has no json output mode; the json is produced entirely on the Go side so it
+// isn't subject to metalava's signature-format limitations.
+func createMergedJson(ctx android.LoadHookContext, txt MergedTxtDefinition, stubsTypeSuffix string) {
+	metalavaCmd := "$(location metalava)"
+	// Silence reflection warnings. See b/168689341
+	metalavaCmd += " -J--add-opens=java.base/java.util=ALL-UNNAMED "
+	metalavaCmd += " --quiet merge-signatures --format=v2 $(in) --out $(genDir)/merged.txt"
+
+	base := strings.TrimSuffix(txt.TxtFilename, ".txt")
+	filename := base + ".json"
+	if txt.Scope != "public" {
+		filename = txt.Scope + "-" + filename
+	}
+	moduleName := ctx.ModuleName() + stubsTypeSuffix + filename
+
+	props := genruleProps{}
+	props.Name = proptools.StringPtr(moduleName)
+	props.Tools = []string{"metalava", "api_contributions"}
+	props.Out = []string{filename}
+	props.Cmd = proptools.StringPtr(metalavaCmd + " && $(location api_contributions) json $(genDir)/merged.txt $(out)")
+	props.Srcs = proptools.NewSimpleConfigurable([]string{txt.BaseTxt})
+	props.Srcs.Append(createSrcs(txt.Modules, txt.ModuleTag))
+	props.Visibility = []string{"//visibility:public"}
+	ctx.CreateModule(genrule.GenRuleFactory, &props)
+}
+
+// scopeAnnotationsTag returns the ApiStubsProvider.AnnotationsZip() output tag (e.g.
+// "{.public.annotations.zip}") that each bootclasspath member exposes for the given scope.
+func scopeAnnotationsTag(scope string) string {
+	return "{." + scope + ".annotations.zip}"
+}
+
+// createMergedAnnotationsZip merges the annotations.zip of every module contributing to txt
+// into a single per-scope zip, e.g. "foo-system-current-annotations.zip", so metalava
+// consumers of the merged API surface can also get its type-use nullability annotations.
+func createMergedAnnotationsZip(ctx android.LoadHookContext, txt MergedTxtDefinition, stubsTypeSuffix string, doDist bool) {
+	filename := "current-annotations.zip"
+	if txt.Scope != "public" {
+		filename = txt.Scope + "-" + filename
+	}
+	moduleName := ctx.ModuleName() + stubsTypeSuffix + filename
+
+	props := genruleProps{}
+	props.Name = proptools.StringPtr(moduleName)
+	props.Tools = []string{"merge_zips"}
+	props.Out = []string{filename}
+	props.Cmd = proptools.StringPtr("$(location merge_zips) $(out) $(in)")
+	props.Srcs = createSrcs(txt.Modules, scopeAnnotationsTag(txt.Scope))
+	if doDist {
+		props.Dists = []android.Dist{
+			{
+				Targets: []string{"api_txt", "sdk"},
+				Dir:     proptools.StringPtr("apistubs/android/" + txt.Scope + "/api"),
+				Dest:    proptools.StringPtr(filename),
+			},
+		}
+	}
+	props.Visibility = []string{"//visibility:public"}
+	ctx.CreateModule(genrule.GenRuleFactory, &props)
+}
+
 func createMergedAnnotationsFilegroups(ctx android.LoadHookContext, modules, system_server_modules proptools.Configurable[[]string]) {
 	for _, i := range []struct {
 		name    string
@@ -218,6 +526,10 @@ func createMergedAnnotationsFilegroups(ctx android.LoadHookContext, modules, sys
 			name:    "all-modules-system-annotations",
 			tag:     "{.system.annotations.zip}",
 			modules: modules,
+		}, {
+			name:    "all-modules-test-annotations",
+			tag:     "{.test.annotations.zip}",
+			modules: modules,
 		}, {
 			name:    "all-modules-module-lib-annotations",
 			tag:     "{.module-lib.annotations.zip}",
@@ -337,6 +649,67 @@ func createMergedTestExportableStubsForNonUpdatableModules(ctx android.LoadHookC
 	ctx.CreateModule(java.LibraryFactory, &props)
 }
 
+func createMergedTestStubs(ctx android.LoadHookContext, modules proptools.Configurable[[]string]) {
+	// First create the all-updatable-modules-test-stubs, mirroring createMergedSystemStubs.
+	{
+		updatable_modules := modules.Clone()
+		removeAll(updatable_modules, non_updatable_modules)
+		transformConfigurableArray(updatable_modules, "", ".stubs.test")
+		props := libraryProps{}
+		props.Name = proptools.StringPtr("all-updatable-modules-test-stubs")
+		props.Static_libs = updatable_modules
+		props.Sdk_version = proptools.StringPtr("module_current")
+		props.Visibility = []string{"//frameworks/base"}
+		props.Is_stubs_module = proptools.BoolPtr(true)
+		ctx.CreateModule(java.LibraryFactory, &props)
+	}
+	// Now merge all-updatable-modules-test-stubs and all-non-updatable-modules-test-stubs
+	// into all-modules-test-stubs.
+	{
+		props := libraryProps{}
+		props.Name = proptools.StringPtr("all-modules-test-stubs")
+		props.Static_libs = proptools.NewSimpleConfigurable([]string{
+			"all-non-updatable-modules-test-stubs",
+			"all-updatable-modules-test-stubs",
+		})
+		props.Sdk_version = proptools.StringPtr("module_current")
+		props.Visibility = []string{"//frameworks/base"}
+		props.Is_stubs_module = proptools.BoolPtr(true)
+		ctx.CreateModule(java.LibraryFactory, &props)
+	}
+}
+
+func createMergedTestExportableStubs(ctx android.LoadHookContext, modules proptools.Configurable[[]string]) {
+	// First create the all-updatable-modules-test-stubs-exportable, mirroring
+	// createMergedSystemExportableStubs.
+	{
+		updatable_modules := modules.Clone()
+		removeAll(updatable_modules, non_updatable_modules)
+		transformConfigurableArray(updatable_modules, "", ".stubs.exportable.test")
+		props := libraryProps{}
+		props.Name = proptools.StringPtr("all-updatable-modules-test-stubs-exportable")
+		props.Static_libs = updatable_modules
+		props.Sdk_version = proptools.StringPtr("module_current")
+		props.Visibility = []string{"//frameworks/base"}
+		props.Is_stubs_module = proptools.BoolPtr(true)
+		ctx.CreateModule(java.LibraryFactory, &props)
+	}
+	// Now merge all-updatable-modules-test-stubs-exportable and
+	// all-non-updatable-modules-test-stubs-exportable into all-modules-test-stubs-exportable.
+	{
+		props := libraryProps{}
+		props.Name = proptools.StringPtr("all-modules-test-stubs-exportable")
+		props.Static_libs = proptools.NewSimpleConfigurable([]string{
+			"all-non-updatable-modules-test-stubs-exportable",
+			"all-updatable-modules-test-stubs-exportable",
+		})
+		props.Sdk_version = proptools.StringPtr("module_current")
+		props.Visibility = []string{"//frameworks/base"}
+		props.Is_stubs_module = proptools.BoolPtr(true)
+		ctx.CreateModule(java.LibraryFactory, &props)
+	}
+}
+
 func createMergedFrameworkImpl(ctx android.LoadHookContext, modules proptools.Configurable[[]string]) {
 	modules = modules.Clone()
 	// This module is for the "framework-all" module, which should not include the core libraries.
@@ -434,55 +807,221 @@ func createPublicStubsSourceFilegroup(ctx android.LoadHookContext, modules propt
 	ctx.CreateModule(android.FileGroupFactory, &props)
 }
 
+// createSdkSnapshot bundles the merged txts, removed.txts, annotations.zips and stub
+// libraries/sources created above into a single versioned zip laid out like
+// apistubs/android/<scope>/{api,source,annotations,stubs}/..., alongside a manifest.json
+// enumerating every staged path and, per scope, the bootclasspath/system_server modules that
+// contributed to it. sdk_snapshot_manifest stages each input at its documented destination path
+// under a scratch directory (and writes the manifest there too); soong_zip then just archives
+// that directory as-is, so the zip layout matches what's documented rather than each input's
+// arbitrary build path. This lets downstream module SDK builds pull one self-describing bundle
+// instead of depending on dozens of individual <module>-stubs* genrules directly, and lets
+// consumers discover which module fed a given scope without reading the Android.bp that built
+// it. Only called when Generate_sdk_snapshot is set.
+func createSdkSnapshot(ctx android.LoadHookContext, version string, scopeModules map[string]proptools.Configurable[[]string]) {
+	prefix := ctx.ModuleName()
+
+	type snapshotEntry struct {
+		dest   string
+		module string
+	}
+	var entries []snapshotEntry
+	for _, scope := range []string{"public", "system", "test", "module-lib", "system-server"} {
+		scopePrefix := ""
+		if scope != "public" {
+			scopePrefix = scope + "-"
+		}
+		entries = append(entries,
+			snapshotEntry{"apistubs/android/" + scope + "/api/current.txt", prefix + "-" + scopePrefix + "current.txt"},
+			snapshotEntry{"apistubs/android/" + scope + "/api/removed.txt", prefix + "-" + scopePrefix + "removed.txt"},
+			snapshotEntry{"apistubs/android/" + scope + "/annotations/annotations.zip", prefix + "-" + scopePrefix + "current-annotations.zip"},
+		)
+	}
+	entries = append(entries,
+		snapshotEntry{"apistubs/android/public/stubs/stubs.jar", "all-modules-public-stubs"},
+		snapshotEntry{"apistubs/android/public/stubs/stubs-exportable.jar", "all-modules-public-stubs-exportable"},
+		snapshotEntry{"apistubs/android/public/source/source.srcjar", "all-modules-public-stubs-source"},
+		snapshotEntry{"apistubs/android/system/stubs/stubs.jar", "all-modules-system-stubs"},
+		snapshotEntry{"apistubs/android/system/stubs/stubs-exportable.jar", "all-modules-system-stubs-exportable"},
+		snapshotEntry{"apistubs/android/test/stubs/stubs.jar", "all-modules-test-stubs"},
+		snapshotEntry{"apistubs/android/test/stubs/stubs-exportable.jar", "all-modules-test-stubs-exportable"},
+		snapshotEntry{"apistubs/android/module-lib/stubs/stubs.jar", "framework-updatable-stubs-module_libs_api"},
+		snapshotEntry{"apistubs/android/module-lib/stubs/stubs-exportable.jar", "framework-updatable-stubs-module_libs_api-exportable"},
+		snapshotEntry{"apistubs/android/system-server/stubs/stubs-exportable.jar", "framework-updatable-stubs-system_server_api-exportable"},
+	)
+
+	var contents []string
+	var manifestArgs []string
+	for _, e := range entries {
+		contents = append(contents, ":"+e.module)
+		manifestArgs = append(manifestArgs, e.dest+"="+"$(location :"+e.module+")")
+	}
+	for _, scope := range []string{"public", "system", "test", "module-lib", "system-server"} {
+		modules := scopeModules[scope].GetOrDefault(ctx, nil)
+		if len(modules) == 0 {
+			continue
+		}
+		manifestArgs = append(manifestArgs, "module:"+scope+"="+strings.Join(modules, ","))
+	}
+
+	filename := "sdk-snapshot-" + version + ".zip"
+	props := genruleProps{}
+	props.Name = proptools.StringPtr(prefix + "-sdk-snapshot")
+	props.Tools = []string{"sdk_snapshot_manifest", "soong_zip"}
+	props.Out = []string{filename}
+	props.Srcs = proptools.NewSimpleConfigurable(contents)
+	props.Cmd = proptools.StringPtr(
+		"$(location sdk_snapshot_manifest) $(genDir)/staging $(genDir)/staging/manifest.json " +
+			version + " " + strings.Join(manifestArgs, " ") +
+			" && $(location soong_zip) -o $(out) -C $(genDir)/staging -D $(genDir)/staging")
+	props.Dists = []android.Dist{
+		{
+			Targets: []string{"sdk_snapshot"},
+			Dir:     proptools.StringPtr("apistubs/android"),
+			Dest:    proptools.StringPtr(filename),
+		},
+	}
+	props.Visibility = []string{"//visibility:public"}
+	ctx.CreateModule(genrule.GenRuleFactory, &props)
+}
+
+// moduleWithMinSdkVersion is implemented by bootclasspath members (e.g. java_sdk_library)
+// that declare the earliest build release they're part of.
+type moduleWithMinSdkVersion interface {
+	MinSdkVersion(ctx android.EarlyModuleContext) android.ApiLevel
+}
+
+// scopeModules returns specific if it's non-empty, otherwise fallback. Used to let a
+// per-scope bootclasspath property (e.g. Module_lib_bootclasspath) override the default
+// flattened Bootclasspath list only for the scope it applies to.
+func scopeModules(ctx android.LoadHookContext, specific, fallback proptools.Configurable[[]string]) proptools.Configurable[[]string] {
+	if len(specific.GetOrDefault(ctx, nil)) > 0 {
+		return specific.Clone()
+	}
+	return fallback.Clone()
+}
+
+// filterByBuildRelease drops modules from a per-scope list whose declared min_sdk_version
+// is newer than buildRelease. A buildRelease of "current" applies no filtering.
+func filterByBuildRelease(ctx android.LoadHookContext, modules proptools.Configurable[[]string], buildRelease string) {
+	if buildRelease == "" || buildRelease == "current" {
+		return
+	}
+	target := android.ApiLevelFromUser(ctx, buildRelease)
+	modules.AddPostProcessor(func(s []string) []string {
+		a := make([]string, 0, len(s))
+		for _, name := range s {
+			mod, exists := ctx.ModuleFromName(name)
+			if !exists {
+				a = append(a, name)
+				continue
+			}
+			if m, ok := mod.(moduleWithMinSdkVersion); ok && m.MinSdkVersion(ctx).GreaterThan(target) {
+				continue
+			}
+			a = append(a, name)
+		}
+		return a
+	})
+}
+
 func createMergedTxts(
 	ctx android.LoadHookContext,
-	bootclasspath proptools.Configurable[[]string],
+	publicBootclasspath proptools.Configurable[[]string],
+	systemBootclasspath proptools.Configurable[[]string],
+	moduleLibBootclasspath proptools.Configurable[[]string],
 	system_server_classpath proptools.Configurable[[]string],
 	baseTxtModulePrefix string,
 	stubsTypeSuffix string,
 	doDist bool,
-) {
+	useExportableStubTags bool,
+	formats []string,
+	previousApiBaselines map[string]string,
+	diffBaselines map[string]string,
+) []string {
 	var textFiles []MergedTxtDefinition
 
+	// When useExportableStubTags is set, pull the per-scope current/removed txt of
+	// each bootclasspath / system server module from its "exportable" (from-source)
+	// stubs variant instead of the regular one, so the merged txt only reflects the
+	// API surface that's actually exported (no non-exportable annotations mixed in).
+	scopeTag := ".public"
+	systemTag := ".system"
+	testTag := ".test"
+	moduleLibTag := ".module-lib"
+	systemServerTag := ".system-server"
+	if useExportableStubTags {
+		scopeTag = ".exportable.public"
+		systemTag = ".exportable.system"
+		testTag = ".exportable.test"
+		moduleLibTag = ".exportable.module-lib"
+		systemServerTag = ".exportable.system-server"
+	}
+
 	tagSuffix := []string{".api.txt}", ".removed-api.txt}"}
 	distFilename := []string{"android.txt", "android-removed.txt"}
 	for i, f := range []string{"current.txt", "removed.txt"} {
 		textFiles = append(textFiles, MergedTxtDefinition{
-			TxtFilename:  f,
-			DistFilename: distFilename[i],
-			BaseTxt:      ":" + baseTxtModulePrefix + f,
-			Modules:      bootclasspath,
-			ModuleTag:    "{.public" + tagSuffix[i],
-			Scope:        "public",
+			TxtFilename:         f,
+			DistFilename:        distFilename[i],
+			BaseTxt:             ":" + baseTxtModulePrefix + f,
+			Modules:             publicBootclasspath,
+			ModuleTag:           "{" + scopeTag + tagSuffix[i],
+			Scope:               "public",
+			Formats:             formats,
+			PreviousApiBaseline: previousApiBaselines["public"],
+			DiffBaseline:        diffBaselines["public"],
+		})
+		textFiles = append(textFiles, MergedTxtDefinition{
+			TxtFilename:         f,
+			DistFilename:        distFilename[i],
+			BaseTxt:             ":" + baseTxtModulePrefix + "system-" + f,
+			Modules:             systemBootclasspath,
+			ModuleTag:           "{" + systemTag + tagSuffix[i],
+			Scope:               "system",
+			Formats:             formats,
+			PreviousApiBaseline: previousApiBaselines["system"],
+			DiffBaseline:        diffBaselines["system"],
 		})
 		textFiles = append(textFiles, MergedTxtDefinition{
-			TxtFilename:  f,
-			DistFilename: distFilename[i],
-			BaseTxt:      ":" + baseTxtModulePrefix + "system-" + f,
-			Modules:      bootclasspath,
-			ModuleTag:    "{.system" + tagSuffix[i],
-			Scope:        "system",
+			TxtFilename:         f,
+			DistFilename:        distFilename[i],
+			BaseTxt:             ":" + baseTxtModulePrefix + "test-" + f,
+			Modules:             publicBootclasspath,
+			ModuleTag:           "{" + testTag + tagSuffix[i],
+			Scope:               "test",
+			Formats:             formats,
+			PreviousApiBaseline: previousApiBaselines["test"],
+			DiffBaseline:        diffBaselines["test"],
 		})
 		textFiles = append(textFiles, MergedTxtDefinition{
-			TxtFilename:  f,
-			DistFilename: distFilename[i],
-			BaseTxt:      ":" + baseTxtModulePrefix + "module-lib-" + f,
-			Modules:      bootclasspath,
-			ModuleTag:    "{.module-lib" + tagSuffix[i],
-			Scope:        "module-lib",
+			TxtFilename:         f,
+			DistFilename:        distFilename[i],
+			BaseTxt:             ":" + baseTxtModulePrefix + "module-lib-" + f,
+			Modules:             moduleLibBootclasspath,
+			ModuleTag:           "{" + moduleLibTag + tagSuffix[i],
+			Scope:               "module-lib",
+			Formats:             formats,
+			PreviousApiBaseline: previousApiBaselines["module-lib"],
+			DiffBaseline:        diffBaselines["module-lib"],
 		})
 		textFiles = append(textFiles, MergedTxtDefinition{
-			TxtFilename:  f,
-			DistFilename: distFilename[i],
-			BaseTxt:      ":" + baseTxtModulePrefix + "system-server-" + f,
-			Modules:      system_server_classpath,
-			ModuleTag:    "{.system-server" + tagSuffix[i],
-			Scope:        "system-server",
+			TxtFilename:         f,
+			DistFilename:        distFilename[i],
+			BaseTxt:             ":" + baseTxtModulePrefix + "system-server-" + f,
+			Modules:             system_server_classpath,
+			ModuleTag:           "{" + systemServerTag + tagSuffix[i],
+			Scope:               "system-server",
+			Formats:             formats,
+			PreviousApiBaseline: previousApiBaselines["system-server"],
+			DiffBaseline:        diffBaselines["system-server"],
 		})
 	}
+	var droidcoreCheckModules []string
 	for _, txt := range textFiles {
-		createMergedTxt(ctx, txt, stubsTypeSuffix, doDist)
+		droidcoreCheckModules = append(droidcoreCheckModules, createMergedTxt(ctx, txt, stubsTypeSuffix, doDist)...)
 	}
+	return droidcoreCheckModules
 }
 
 func (a *CombinedApis) createInternalModules(ctx android.LoadHookContext) {
@@ -491,24 +1030,49 @@ func (a *CombinedApis) createInternalModules(ctx android.LoadHookContext) {
 	if ctx.Config().VendorConfig("ANDROID").Bool("include_nonpublic_framework_api") {
 		bootclasspath.AppendSimpleValue(a.properties.Conditional_bootclasspath)
 	}
-	createMergedTxts(ctx, bootclasspath, system_server_classpath, "non-updatable-", "-", false)
-	createMergedTxts(ctx, bootclasspath, system_server_classpath, "non-updatable-exportable-", "-exportable-", true)
+
+	buildRelease := a.buildRelease()
+	systemBootclasspath := scopeModules(ctx, a.properties.System_bootclasspath, bootclasspath)
+	moduleLibBootclasspath := scopeModules(ctx, a.properties.Module_lib_bootclasspath, bootclasspath)
+	systemServerBootclasspath := scopeModules(ctx, a.properties.System_server_bootclasspath, system_server_classpath)
+	for _, modules := range []proptools.Configurable[[]string]{systemBootclasspath, moduleLibBootclasspath, systemServerBootclasspath} {
+		filterByBuildRelease(ctx, modules, buildRelease)
+	}
+
+	formats := a.formats()
+	a.droidcoreCheckModules = createMergedTxts(ctx, bootclasspath, systemBootclasspath, moduleLibBootclasspath, systemServerBootclasspath, "non-updatable-", "-", false, false, formats, a.properties.Previous_api_baselines, a.properties.Diff_baselines)
+	createMergedTxts(ctx, bootclasspath, systemBootclasspath, moduleLibBootclasspath, systemServerBootclasspath, "non-updatable-exportable-", "-exportable-", true, true, formats, nil, nil)
 
 	createMergedPublicStubs(ctx, bootclasspath)
 	createMergedSystemStubs(ctx, bootclasspath)
 	createMergedTestStubsForNonUpdatableModules(ctx)
+	createMergedTestStubs(ctx, bootclasspath)
 	createMergedFrameworkModuleLibStubs(ctx, bootclasspath)
 	createMergedFrameworkImpl(ctx, bootclasspath)
 
 	createMergedPublicExportableStubs(ctx, bootclasspath)
 	createMergedSystemExportableStubs(ctx, bootclasspath)
 	createMergedTestExportableStubsForNonUpdatableModules(ctx)
+	createMergedTestExportableStubs(ctx, bootclasspath)
 	createMergedFrameworkModuleLibExportableStubs(ctx, bootclasspath)
 	createMergedFrameworkSystemServerExportableStubs(ctx, bootclasspath, system_server_classpath)
 
 	createMergedAnnotationsFilegroups(ctx, bootclasspath, system_server_classpath)
 
 	createPublicStubsSourceFilegroup(ctx, bootclasspath)
+
+	if proptools.Bool(a.properties.Generate_sdk_snapshot) {
+		createSdkSnapshot(ctx, a.snapshotVersion(), map[string]proptools.Configurable[[]string]{
+			"public": bootclasspath,
+			"system": systemBootclasspath,
+			// createMergedTxts derives the merged test txt from the plain bootclasspath
+			// too (see its "test" MergedTxtDefinition above), so the snapshot's test
+			// scope attributes to the same contributing modules.
+			"test":          bootclasspath,
+			"module-lib":    moduleLibBootclasspath,
+			"system-server": systemServerBootclasspath,
+		})
+	}
 }
 
 func combinedApisModuleFactory() android.Module {
@@ -0,0 +1,107 @@
+// Copyright (C) 2024 The Android Open Source Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// api_contributions converts metalava signature-format-2.0 txt files into the structured
+// api_contributions records consumed by combined_apis, e.g. merging them into per-class JSON
+// or diffing a baseline against a current merged txt.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+	var err error
+	switch os.Args[1] {
+	case "json":
+		err = runJson(os.Args[2:])
+	case "diff":
+		err = runDiff(os.Args[2:])
+	default:
+		usage()
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "api_contributions: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: api_contributions json <in-signature-v2.txt> <out.json>")
+	fmt.Fprintln(os.Stderr, "       api_contributions diff <baseline.txt> <current.txt> <out.txt> <out.json>")
+	os.Exit(1)
+}
+
+// runJson walks the classes parsed out of a merged signature-v2 txt and writes them as JSON
+// records of the form {package,class,members:[{kind,name,signature,since,deprecated}]}.
+func runJson(args []string) error {
+	if len(args) != 2 {
+		usage()
+	}
+	contents, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	classes := parseSignatureV2(string(contents))
+	out, err := json.MarshalIndent(classes, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(args[1], out, 0644)
+}
+
+// runDiff compares the members of a baseline signature-v2 txt against a current merged one and
+// writes the added/removed/changed records in both a human-readable txt and a machine-readable
+// json form. Unlike metalava's --check-compatibility mode, this always exits 0 so that an
+// incompatible change is reported rather than aborting the build.
+func runDiff(args []string) error {
+	if len(args) != 4 {
+		usage()
+	}
+	baselineContents, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	currentContents, err := os.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	result := diffSignatures(parseSignatureV2(string(baselineContents)), parseSignatureV2(string(currentContents)))
+
+	var txt strings.Builder
+	for _, r := range result.Added {
+		fmt.Fprintf(&txt, "+ %s.%s: %s\n", r.Class, r.Name, r.Signature)
+	}
+	for _, r := range result.Removed {
+		fmt.Fprintf(&txt, "- %s.%s: %s\n", r.Class, r.Name, r.Signature)
+	}
+	for _, r := range result.Changed {
+		fmt.Fprintf(&txt, "! %s.%s: %s -> %s\n", r.Class, r.Name, r.From, r.To)
+	}
+	if err := os.WriteFile(args[2], []byte(txt.String()), 0644); err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(args[3], out, 0644)
+}
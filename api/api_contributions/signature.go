@@ -0,0 +1,261 @@
+// Copyright (C) 2024 The Android Open Source Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// member is a single class member (ctor, method or field) contributed by a signature-v2 entry.
+type member struct {
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Signature string `json:"signature"`
+	// Since is always empty: signature-v2 txt carries no per-member version metadata to
+	// populate it from.
+	Since      string `json:"since"`
+	Deprecated bool   `json:"deprecated"`
+}
+
+// class is one package-level class/interface/enum/@interface declaration and its direct members.
+type class struct {
+	Package string   `json:"package"`
+	Class   string   `json:"class"`
+	Members []member `json:"members"`
+}
+
+var packageDeclRe = regexp.MustCompile(`^package\s+([\w.]+)\s*\{`)
+var classDeclRe = regexp.MustCompile(`\b(?:class|interface|enum|@interface)\s+([A-Za-z0-9_$.]+)`)
+
+// parseSignatureV2 walks a metalava signature-format-2.0 file and returns one class entry per
+// class/interface/enum/@interface declaration at package level, with its direct members. A
+// nested class declared at package level as "Outer.Inner" gets its own entry named
+// "Outer.Inner" rather than being folded into the enclosing class, since its signatures belong
+// to a different class. Any brace scope opened inside a class body is skipped.
+func parseSignatureV2(contents string) []class {
+	var classes []class
+	var pkg string
+	var current *class
+	// One entry per open brace: "package", "class" (the entry we're currently collecting
+	// members for) or "other" (a nested scope we don't parse, e.g. an inner class).
+	var scopes []string
+
+	for _, rawLine := range strings.Split(contents, "\n") {
+		line := strings.TrimSpace(rawLine)
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		// Strip a trailing "// ..." comment (e.g. the hex value metalava appends to
+		// constants) before checking how the line ends.
+		if idx := strings.Index(line, "//"); idx >= 0 {
+			line = strings.TrimSpace(line[:idx])
+		}
+		top := ""
+		if len(scopes) > 0 {
+			top = scopes[len(scopes)-1]
+		}
+		switch {
+		case strings.HasSuffix(line, "{"):
+			switch top {
+			case "":
+				if m := packageDeclRe.FindStringSubmatch(line); m != nil {
+					pkg = m[1]
+				}
+				scopes = append(scopes, "package")
+			case "package":
+				name := line
+				if m := classDeclRe.FindStringSubmatch(line); m != nil {
+					name = m[1]
+				}
+				current = &class{Package: pkg, Class: name}
+				scopes = append(scopes, "class")
+			default:
+				scopes = append(scopes, "other")
+			}
+		case line == "}":
+			if len(scopes) == 0 {
+				continue
+			}
+			popped := scopes[len(scopes)-1]
+			scopes = scopes[:len(scopes)-1]
+			if popped == "class" && current != nil {
+				classes = append(classes, *current)
+				current = nil
+			}
+		case top == "class" && strings.HasSuffix(line, ";"):
+			current.Members = append(current.Members, parseMember(line))
+		}
+	}
+	return classes
+}
+
+func parseMember(line string) member {
+	sig := strings.TrimSuffix(line, ";")
+	if idx := strings.Index(sig, "//"); idx >= 0 {
+		sig = strings.TrimSpace(sig[:idx])
+	}
+	fields := strings.Fields(sig)
+	kind := ""
+	if len(fields) > 0 {
+		kind = fields[0]
+	}
+	deprecated := false
+	for _, f := range fields {
+		if f == "@Deprecated" {
+			deprecated = true
+			break
+		}
+	}
+	return member{
+		Kind:       kind,
+		Name:       memberName(sig),
+		Signature:  sig,
+		Deprecated: deprecated,
+	}
+}
+
+// memberName extracts the member identifier from a trimmed, semicolon-stripped signature line,
+// e.g. "method public void foo()" -> "foo", "field public static final int BAR = 1" -> "BAR".
+func memberName(sig string) string {
+	head := sig
+	if idx := strings.Index(head, "("); idx >= 0 {
+		head = head[:idx]
+	} else if idx := strings.Index(head, "="); idx >= 0 {
+		head = head[:idx]
+	}
+	fields := strings.Fields(head)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[len(fields)-1]
+}
+
+// memberDiff is one added, removed or changed member found by diffSignatures.
+type memberDiff struct {
+	Class     string `json:"class"`
+	Name      string `json:"name"`
+	Signature string `json:"signature,omitempty"`
+	From      string `json:"from,omitempty"`
+	To        string `json:"to,omitempty"`
+}
+
+// signatureDiff is the full result of comparing a baseline and a current set of classes.
+type signatureDiff struct {
+	Added   []memberDiff `json:"added"`
+	Removed []memberDiff `json:"removed"`
+	Changed []memberDiff `json:"changed"`
+}
+
+// diffSignatures compares the members of baseline against current, keyed as indexMembers does,
+// and reports what was added, removed or changed. It never fails: callers decide what, if
+// anything, to do with an incompatible result. Each result slice is sorted by class, member
+// name and then signature so that diffing the same inputs always produces the same dist'd
+// artifact.
+func diffSignatures(baseline, current []class) signatureDiff {
+	baseMembers := indexMembers(baseline)
+	curMembers := indexMembers(current)
+
+	var diff signatureDiff
+	for key, cur := range curMembers {
+		base, ok := baseMembers[key]
+		if !ok {
+			diff.Added = append(diff.Added, memberDiff{Class: cur.class, Name: cur.member.Name, Signature: cur.member.Signature})
+		} else if base.member.Signature != cur.member.Signature {
+			diff.Changed = append(diff.Changed, memberDiff{Class: cur.class, Name: cur.member.Name, From: base.member.Signature, To: cur.member.Signature})
+		}
+	}
+	for key, base := range baseMembers {
+		if _, ok := curMembers[key]; !ok {
+			diff.Removed = append(diff.Removed, memberDiff{Class: base.class, Name: base.member.Name, Signature: base.member.Signature})
+		}
+	}
+	sortMemberDiffs(diff.Added)
+	sortMemberDiffs(diff.Removed)
+	sortMemberDiffs(diff.Changed)
+	return diff
+}
+
+// sortMemberDiffs orders a memberDiff slice by class, member name and then signature (so
+// overloads sharing a name are ordered too), giving diffSignatures a deterministic result
+// independent of Go's randomized map iteration order.
+func sortMemberDiffs(diffs []memberDiff) {
+	sort.Slice(diffs, func(i, j int) bool {
+		if diffs[i].Class != diffs[j].Class {
+			return diffs[i].Class < diffs[j].Class
+		}
+		if diffs[i].Name != diffs[j].Name {
+			return diffs[i].Name < diffs[j].Name
+		}
+		if diffs[i].Signature != diffs[j].Signature {
+			return diffs[i].Signature < diffs[j].Signature
+		}
+		return diffs[i].From < diffs[j].From
+	})
+}
+
+type classMember struct {
+	class  string
+	member member
+}
+
+// indexMembers flattens a parsed class list into a lookup keyed by fully-qualified class,
+// member kind, name and parameter types, so diffSignatures can match the same member across
+// baseline and current. Parameter types (rather than the full signature) are part of the key
+// so that overloaded methods/ctors are tracked as distinct members instead of colliding into
+// one, while a member whose return type, modifiers, etc. changed is still matched as the same
+// member and reported as Changed rather than as an unrelated Added+Removed pair.
+func indexMembers(classes []class) map[string]classMember {
+	members := make(map[string]classMember)
+	for _, c := range classes {
+		fqClass := c.Package + "." + c.Class
+		for _, m := range c.Members {
+			key := fqClass + "#" + m.Kind + "#" + m.Name + "#" + paramTypes(m.Signature)
+			members[key] = classMember{class: fqClass, member: m}
+		}
+	}
+	return members
+}
+
+// paramTypes extracts the comma-separated parameter types from a method/ctor signature, e.g.
+// "method public void baz(int x, String y)" -> "int,String". Returns "" for signatures with no
+// parameter list (fields) or an empty one.
+func paramTypes(sig string) string {
+	open := strings.Index(sig, "(")
+	shut := strings.LastIndex(sig, ")")
+	if open < 0 || shut < 0 || shut <= open {
+		return ""
+	}
+	params := strings.TrimSpace(sig[open+1 : shut])
+	if params == "" {
+		return ""
+	}
+	var types []string
+	for _, p := range strings.Split(params, ",") {
+		fields := strings.Fields(strings.TrimSpace(p))
+		if len(fields) == 0 {
+			continue
+		}
+		// Each param is "<type> <name>"; drop the trailing name to key on type alone so a
+		// param rename doesn't look like a different overload.
+		if len(fields) == 1 {
+			types = append(types, fields[0])
+		} else {
+			types = append(types, strings.Join(fields[:len(fields)-1], " "))
+		}
+	}
+	return strings.Join(types, ",")
+}
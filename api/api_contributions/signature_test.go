@@ -0,0 +1,151 @@
+// Copyright (C) 2024 The Android Open Source Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "testing"
+
+const sampleSignature = `// Signature format: 2.0
+package foo {
+
+  public class Bar {
+    ctor public Bar();
+    method public void baz();
+    field public static final int CONST = 1; // 0x1
+  }
+
+  public interface Iface {
+    method @Deprecated public void oldMethod();
+  }
+
+}
+`
+
+func TestParseSignatureV2(t *testing.T) {
+	classes := parseSignatureV2(sampleSignature)
+	if len(classes) != 2 {
+		t.Fatalf("expected 2 classes, got %d: %v", len(classes), classes)
+	}
+
+	bar := classes[0]
+	if bar.Package != "foo" || bar.Class != "Bar" {
+		t.Errorf("unexpected class entry: %+v", bar)
+	}
+	if len(bar.Members) != 3 {
+		t.Fatalf("expected 3 members for Bar, got %d: %v", len(bar.Members), bar.Members)
+	}
+	if bar.Members[0].Kind != "ctor" || bar.Members[0].Name != "Bar" {
+		t.Errorf("unexpected ctor member: %+v", bar.Members[0])
+	}
+	if bar.Members[1].Kind != "method" || bar.Members[1].Name != "baz" {
+		t.Errorf("unexpected method member: %+v", bar.Members[1])
+	}
+	if bar.Members[2].Kind != "field" || bar.Members[2].Name != "CONST" {
+		t.Errorf("unexpected field member: %+v", bar.Members[2])
+	}
+
+	iface := classes[1]
+	if iface.Class != "Iface" {
+		t.Errorf("unexpected class entry: %+v", iface)
+	}
+	if len(iface.Members) != 1 || !iface.Members[0].Deprecated {
+		t.Errorf("expected oldMethod to be parsed as deprecated: %+v", iface.Members)
+	}
+}
+
+const sampleSignatureCurrent = `// Signature format: 2.0
+package foo {
+
+  public class Bar {
+    ctor public Bar();
+    method public final void baz();
+  }
+
+  public class Baz {
+    method public void newMethod();
+  }
+
+}
+`
+
+func TestDiffSignatures(t *testing.T) {
+	baseline := parseSignatureV2(sampleSignature)
+	current := parseSignatureV2(sampleSignatureCurrent)
+	diff := diffSignatures(baseline, current)
+
+	if len(diff.Added) != 1 || diff.Added[0].Name != "newMethod" {
+		t.Errorf("expected newMethod to be added, got %+v", diff.Added)
+	}
+	if len(diff.Removed) != 2 || diff.Removed[0].Name != "CONST" || diff.Removed[1].Name != "oldMethod" {
+		t.Errorf("expected CONST then oldMethod to be removed in class order, got %+v", diff.Removed)
+	}
+	if len(diff.Changed) != 1 || diff.Changed[0].Name != "baz" {
+		t.Errorf("expected baz to be changed, got %+v", diff.Changed)
+	}
+}
+
+const sampleOverloadsBaseline = `// Signature format: 2.0
+package foo {
+
+  public class Bar {
+    method public void baz(int x);
+    method public void baz(String s);
+  }
+
+}
+`
+
+const sampleOverloadsCurrent = `// Signature format: 2.0
+package foo {
+
+  public class Bar {
+    method public void baz(String s);
+    method public void baz(long x);
+  }
+
+}
+`
+
+func TestDiffSignaturesDistinguishesOverloads(t *testing.T) {
+	baseline := parseSignatureV2(sampleOverloadsBaseline)
+	current := parseSignatureV2(sampleOverloadsCurrent)
+	diff := diffSignatures(baseline, current)
+
+	if len(diff.Added) != 1 || diff.Added[0].Signature != "method public void baz(long x)" {
+		t.Errorf("expected baz(long) to be added, got %+v", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0].Signature != "method public void baz(int x)" {
+		t.Errorf("expected baz(int) to be removed, got %+v", diff.Removed)
+	}
+	if len(diff.Changed) != 0 {
+		t.Errorf("expected baz(String) to be unchanged, got %+v", diff.Changed)
+	}
+}
+
+func TestDiffSignaturesIsDeterministic(t *testing.T) {
+	baseline := parseSignatureV2(sampleSignature)
+	current := parseSignatureV2(sampleSignatureCurrent)
+	want := diffSignatures(baseline, current)
+	for i := 0; i < 10; i++ {
+		got := diffSignatures(baseline, current)
+		if len(got.Added) != len(want.Added) || len(got.Removed) != len(want.Removed) || len(got.Changed) != len(want.Changed) {
+			t.Fatalf("diffSignatures result shape changed across runs: got %+v, want %+v", got, want)
+		}
+		for j := range want.Removed {
+			if got.Removed[j] != want.Removed[j] {
+				t.Fatalf("diffSignatures order changed across runs at Removed[%d]: got %+v, want %+v", j, got.Removed[j], want.Removed[j])
+			}
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"android/soong/android"
 	"android/soong/java"
 	"fmt"
+	"strings"
 	"testing"
 
 	"github.com/google/blueprint/proptools"
@@ -257,3 +258,497 @@ func TestCombinedApisDefaults(t *testing.T) {
 	android.AssertBoolEquals(t, "Submodule expected to depend on the select-appended module",
 		true, subModuleDependsOnSelectAppendedModule)
 }
+
+func TestCombinedApisModuleLibBootclasspath(t *testing.T) {
+
+	result := android.GroupFixturePreparers(
+		prepareForTestWithCombinedApis,
+		java.FixtureWithLastReleaseApis(
+			"framework-location", "framework-virtualization", "framework-foo", "framework-bar"),
+	).RunTestWithBp(t, `
+	java_sdk_library {
+		name: "framework-foo",
+		srcs: ["a.java"],
+		public: {
+			enabled: true,
+		},
+		system: {
+			enabled: true,
+		},
+		test: {
+			enabled: true,
+		},
+		module_lib: {
+			enabled: true,
+		},
+		api_packages: [
+			"foo",
+		],
+		sdk_version: "core_current",
+		annotations_enabled: true,
+	}
+	java_sdk_library {
+		name: "framework-bar",
+		srcs: ["a.java"],
+		public: {
+			enabled: true,
+		},
+		system: {
+			enabled: true,
+		},
+		test: {
+			enabled: true,
+		},
+		module_lib: {
+			enabled: true,
+		},
+		api_packages: [
+			"foo",
+		],
+		sdk_version: "core_current",
+		annotations_enabled: true,
+	}
+
+	combined_apis {
+		name: "foo",
+		bootclasspath: ["framework-bar"],
+		module_lib_bootclasspath: ["framework-bar", "framework-foo"],
+	}
+	`)
+
+	moduleLibDependsOnOverrideOnlyModule := java.CheckModuleHasDependency(t,
+		result.TestContext, "foo-module-lib-current.txt", "", "framework-foo")
+	android.AssertBoolEquals(t, "module-lib txt expected to depend on module_lib_bootclasspath-only module",
+		true, moduleLibDependsOnOverrideOnlyModule)
+
+	publicDependsOnOverrideOnlyModule := java.CheckModuleHasDependency(t,
+		result.TestContext, "foo-current.txt", "", "framework-foo")
+	android.AssertBoolEquals(t, "public txt not expected to depend on a module_lib-only module",
+		false, publicDependsOnOverrideOnlyModule)
+}
+
+func TestCombinedApisBuildReleaseFiltering(t *testing.T) {
+
+	result := android.GroupFixturePreparers(
+		prepareForTestWithCombinedApis,
+		java.FixtureWithLastReleaseApis(
+			"framework-location", "framework-virtualization", "framework-foo", "framework-bar"),
+	).RunTestWithBp(t, `
+	java_sdk_library {
+		name: "framework-foo",
+		srcs: ["a.java"],
+		min_sdk_version: "31",
+		public: {
+			enabled: true,
+		},
+		system: {
+			enabled: true,
+		},
+		test: {
+			enabled: true,
+		},
+		module_lib: {
+			enabled: true,
+		},
+		api_packages: [
+			"foo",
+		],
+		sdk_version: "core_current",
+		annotations_enabled: true,
+	}
+	java_sdk_library {
+		name: "framework-bar",
+		srcs: ["a.java"],
+		min_sdk_version: "30",
+		public: {
+			enabled: true,
+		},
+		system: {
+			enabled: true,
+		},
+		test: {
+			enabled: true,
+		},
+		module_lib: {
+			enabled: true,
+		},
+		api_packages: [
+			"foo",
+		],
+		sdk_version: "core_current",
+		annotations_enabled: true,
+	}
+
+	combined_apis {
+		name: "foo",
+		bootclasspath: ["framework-bar", "framework-foo"],
+		build_release: "30",
+	}
+	`)
+
+	moduleLibDependsOnTooNewModule := java.CheckModuleHasDependency(t,
+		result.TestContext, "foo-module-lib-current.txt", "", "framework-foo")
+	android.AssertBoolEquals(t, "module-lib txt not expected to depend on a module newer than build_release",
+		false, moduleLibDependsOnTooNewModule)
+
+	moduleLibDependsOnModule := java.CheckModuleHasDependency(t,
+		result.TestContext, "foo-module-lib-current.txt", "", "framework-bar")
+	android.AssertBoolEquals(t, "module-lib txt expected to depend on a module no newer than build_release",
+		true, moduleLibDependsOnModule)
+
+	publicDependsOnTooNewModule := java.CheckModuleHasDependency(t,
+		result.TestContext, "foo-current.txt", "", "framework-foo")
+	android.AssertBoolEquals(t, "public txt (unfiltered bootclasspath) still expected to depend on the too-new module",
+		true, publicDependsOnTooNewModule)
+}
+
+func TestCombinedApisAnnotationsMerged(t *testing.T) {
+
+	result := android.GroupFixturePreparers(
+		prepareForTestWithCombinedApis,
+		java.FixtureWithLastReleaseApis(
+			"framework-location", "framework-virtualization", "framework-foo"),
+	).RunTestWithBp(t, `
+	java_sdk_library {
+		name: "framework-foo",
+		srcs: ["a.java"],
+		public: {
+			enabled: true,
+		},
+		system: {
+			enabled: true,
+		},
+		test: {
+			enabled: true,
+		},
+		module_lib: {
+			enabled: true,
+		},
+		api_packages: [
+			"foo",
+		],
+		sdk_version: "core_current",
+		annotations_enabled: true,
+	}
+
+	combined_apis {
+		name: "foo",
+		bootclasspath: ["framework-foo"],
+	}
+	`)
+
+	mergedAnnotationsDependsOnModule := java.CheckModuleHasDependency(t,
+		result.TestContext, "foo-current-annotations.zip", "", "framework-foo")
+	android.AssertBoolEquals(t, "merged annotations zip expected to depend on contributing sdk_library",
+		true, mergedAnnotationsDependsOnModule)
+}
+
+func TestCombinedApisExportableStubs(t *testing.T) {
+
+	result := android.GroupFixturePreparers(
+		prepareForTestWithCombinedApis,
+		java.FixtureWithLastReleaseApis(
+			"framework-location", "framework-virtualization", "framework-foo"),
+	).RunTestWithBp(t, `
+	java_sdk_library {
+		name: "framework-foo",
+		srcs: ["a.java"],
+		public: {
+			enabled: true,
+		},
+		system: {
+			enabled: true,
+		},
+		test: {
+			enabled: true,
+		},
+		module_lib: {
+			enabled: true,
+		},
+		api_packages: [
+			"foo",
+		],
+		sdk_version: "core_current",
+		annotations_enabled: true,
+	}
+
+	combined_apis {
+		name: "foo",
+		bootclasspath: ["framework-foo"],
+	}
+	`)
+
+	exportableDependsOnModule := java.CheckModuleHasDependency(t,
+		result.TestContext, "foo-exportable-current.txt", "", "framework-foo")
+	android.AssertBoolEquals(t, "merged exportable current.txt expected to depend on contributing sdk_library",
+		true, exportableDependsOnModule)
+
+	// The exportable merge must pull framework-foo's exportable stubs variant, distinct from
+	// the plain variant the non-exportable merge below uses. Asserting both module deps exist
+	// isn't enough to catch the two passes being wired to the same tag -- that regression still
+	// has "foo-current.txt" and "foo-exportable-current.txt" both depend on framework-foo, just
+	// via the same (wrong) tag -- so compare the resolved input each genrule actually consumes.
+	exportableCmd := result.ModuleForTests(t, "foo-exportable-current.txt", "").Output("current.txt").Args["cmd"]
+	plainCmd := result.ModuleForTests(t, "foo-current.txt", "").Output("current.txt").Args["cmd"]
+	if !strings.Contains(exportableCmd, "exportable") {
+		t.Errorf("expected foo-exportable-current.txt to consume framework-foo's exportable stubs, got cmd: %s", exportableCmd)
+	}
+	if strings.Contains(plainCmd, "exportable") {
+		t.Errorf("expected foo-current.txt to consume framework-foo's plain (non-exportable) stubs, got cmd: %s", plainCmd)
+	}
+}
+
+func TestCombinedApisFormats(t *testing.T) {
+
+	result := android.GroupFixturePreparers(
+		prepareForTestWithCombinedApis,
+		java.FixtureWithLastReleaseApis(
+			"framework-location", "framework-virtualization", "framework-foo"),
+	).RunTestWithBp(t, `
+	java_sdk_library {
+		name: "framework-foo",
+		srcs: ["a.java"],
+		public: {
+			enabled: true,
+		},
+		system: {
+			enabled: true,
+		},
+		test: {
+			enabled: true,
+		},
+		module_lib: {
+			enabled: true,
+		},
+		api_packages: [
+			"foo",
+		],
+		sdk_version: "core_current",
+		annotations_enabled: true,
+	}
+
+	combined_apis {
+		name: "foo",
+		bootclasspath: ["framework-foo"],
+		formats: ["signature-v2", "signature-v5", "json"],
+	}
+	`)
+
+	// ModuleForTests panics if the named submodule wasn't generated, so simply looking
+	// up all three formats' outputs is enough to assert they exist.
+	result.ModuleForTests(t, "foo-current.txt", "")
+	result.ModuleForTests(t, "foo-current.v5.txt", "")
+	result.ModuleForTests(t, "foo-current.json", "")
+}
+
+func TestCombinedApisCompatibilityCheck(t *testing.T) {
+
+	result := android.GroupFixturePreparers(
+		prepareForTestWithCombinedApis,
+		java.FixtureWithLastReleaseApis(
+			"framework-location", "framework-virtualization", "framework-foo"),
+		android.FixtureAddTextFile("a/latest/Android.bp", `
+			filegroup {
+				name: "android.api.public.latest",
+			}
+		`),
+	).RunTestWithBp(t, `
+	java_sdk_library {
+		name: "framework-foo",
+		srcs: ["a.java"],
+		public: {
+			enabled: true,
+		},
+		system: {
+			enabled: true,
+		},
+		test: {
+			enabled: true,
+		},
+		module_lib: {
+			enabled: true,
+		},
+		api_packages: [
+			"foo",
+		],
+		sdk_version: "core_current",
+		annotations_enabled: true,
+	}
+
+	combined_apis {
+		name: "foo",
+		bootclasspath: ["framework-foo"],
+		previous_api_baselines: {
+			"public": "android.api.public.latest",
+		},
+	}
+	`)
+
+	compatCheckDependsOnMergedTxt := java.CheckModuleHasDependency(t,
+		result.TestContext, "foo-current-compat-check.stamp", "", "foo-current.txt")
+	android.AssertBoolEquals(t, "compat check expected to depend on the merged current.txt",
+		true, compatCheckDependsOnMergedTxt)
+
+	// The compat check stamp must be a real build-time dependency of the combined_apis
+	// module (and hence of droidcore), not just an opt-in `m dist` artifact.
+	combinedApisDependsOnCompatCheck := java.CheckModuleHasDependency(t,
+		result.TestContext, "foo", "", "foo-current-compat-check.stamp")
+	android.AssertBoolEquals(t, "combined_apis expected to depend on its compat check stamp",
+		true, combinedApisDependsOnCompatCheck)
+}
+
+func TestCombinedApisTestScope(t *testing.T) {
+
+	result := android.GroupFixturePreparers(
+		prepareForTestWithCombinedApis,
+		java.FixtureWithLastReleaseApis(
+			"framework-location", "framework-virtualization", "framework-foo"),
+	).RunTestWithBp(t, `
+	java_sdk_library {
+		name: "framework-foo",
+		srcs: ["a.java"],
+		public: {
+			enabled: true,
+		},
+		system: {
+			enabled: true,
+		},
+		test: {
+			enabled: true,
+		},
+		module_lib: {
+			enabled: true,
+		},
+		api_packages: [
+			"foo",
+		],
+		sdk_version: "core_current",
+		annotations_enabled: true,
+	}
+
+	combined_apis {
+		name: "foo",
+		bootclasspath: ["framework-foo"],
+	}
+	`)
+
+	testTxtDependsOnModule := java.CheckModuleHasDependency(t,
+		result.TestContext, "foo-test-current.txt", "", "framework-foo")
+	android.AssertBoolEquals(t, "merged test txt expected to depend on contributing sdk_library",
+		true, testTxtDependsOnModule)
+
+	allModulesTestStubsDependsOnModule := java.CheckModuleHasDependency(t,
+		result.TestContext, "all-updatable-modules-test-stubs", "", "framework-foo.stubs.test")
+	android.AssertBoolEquals(t, "all-updatable-modules-test-stubs expected to depend on contributing sdk_library's test stubs",
+		true, allModulesTestStubsDependsOnModule)
+}
+
+func TestCombinedApisSdkSnapshot(t *testing.T) {
+
+	result := android.GroupFixturePreparers(
+		prepareForTestWithCombinedApis,
+		java.FixtureWithLastReleaseApis(
+			"framework-location", "framework-virtualization", "framework-foo"),
+	).RunTestWithBp(t, `
+	java_sdk_library {
+		name: "framework-foo",
+		srcs: ["a.java"],
+		public: {
+			enabled: true,
+		},
+		system: {
+			enabled: true,
+		},
+		test: {
+			enabled: true,
+		},
+		module_lib: {
+			enabled: true,
+		},
+		api_packages: [
+			"foo",
+		],
+		sdk_version: "core_current",
+		annotations_enabled: true,
+	}
+
+	combined_apis {
+		name: "foo",
+		bootclasspath: ["framework-foo"],
+		generate_sdk_snapshot: true,
+		snapshot_version: "current",
+	}
+	`)
+
+	snapshotDependsOnMergedTxt := java.CheckModuleHasDependency(t,
+		result.TestContext, "foo-sdk-snapshot", "", "foo-current.txt")
+	android.AssertBoolEquals(t, "sdk snapshot expected to depend on the merged current.txt",
+		true, snapshotDependsOnMergedTxt)
+
+	// The manifest must let a consumer discover which bootclasspath module fed each scope,
+	// not just where the merged files landed.
+	cmd := result.ModuleForTests(t, "foo-sdk-snapshot", "").Output("sdk-snapshot-current.zip").Args["cmd"]
+	if !strings.Contains(cmd, "module:public=framework-foo") {
+		t.Errorf("expected sdk snapshot manifest to record framework-foo as a public scope contributor, got cmd: %s", cmd)
+	}
+}
+
+func TestCombinedApisApiDiff(t *testing.T) {
+
+	result := android.GroupFixturePreparers(
+		prepareForTestWithCombinedApis,
+		java.FixtureWithLastReleaseApis(
+			"framework-location", "framework-virtualization", "framework-foo"),
+		android.FixtureAddTextFile("a/latest/Android.bp", `
+			filegroup {
+				name: "android.api.public.latest",
+			}
+		`),
+	).RunTestWithBp(t, `
+	java_sdk_library {
+		name: "framework-foo",
+		srcs: ["a.java"],
+		public: {
+			enabled: true,
+		},
+		system: {
+			enabled: true,
+		},
+		test: {
+			enabled: true,
+		},
+		module_lib: {
+			enabled: true,
+		},
+		api_packages: [
+			"foo",
+		],
+		sdk_version: "core_current",
+		annotations_enabled: true,
+	}
+
+	combined_apis {
+		name: "foo",
+		bootclasspath: ["framework-foo"],
+		diff_baselines: {
+			"public": "android.api.public.latest",
+		},
+	}
+	`)
+
+	apiDiffDependsOnMergedTxt := java.CheckModuleHasDependency(t,
+		result.TestContext, "foo-api-diff", "", "foo-current.txt")
+	android.AssertBoolEquals(t, "api diff expected to depend on the merged current.txt",
+		true, apiDiffDependsOnMergedTxt)
+
+	// The diff must be produced by the api_contributions tool (which always succeeds and
+	// reports added/removed/changed members), not a metalava --check-compatibility mode
+	// (which aborts instead of reporting on an incompatible change).
+	cmd := result.ModuleForTests(t, "foo-api-diff", "").Output("api-diff.txt").Args["cmd"]
+	if !strings.Contains(cmd, "api_contributions) diff") {
+		t.Errorf("expected api-diff genrule to invoke `api_contributions diff`, got: %s", cmd)
+	}
+	if strings.Contains(cmd, "check-compatibility") {
+		t.Errorf("api-diff genrule must not use metalava --check-compatibility, got: %s", cmd)
+	}
+}
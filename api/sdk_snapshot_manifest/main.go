@@ -0,0 +1,115 @@
+// Copyright (C) 2024 The Android Open Source Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// sdk_snapshot_manifest stages the merged txts, removed.txts, annotations.zips and stub
+// libraries/sources combined_apis collects into the apistubs/android/<scope>/... layout an SDK
+// snapshot zip is documented to have, and writes a manifest.json enumerating the staged paths.
+// The caller (combined_apis's createSdkSnapshot) is expected to soong_zip the staging directory
+// afterwards; this tool only lays files out, it doesn't produce the zip itself.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+func main() {
+	if len(os.Args) < 4 {
+		usage()
+	}
+	if err := run(os.Args[1], os.Args[2], os.Args[3], os.Args[4:]); err != nil {
+		fmt.Fprintln(os.Stderr, "sdk_snapshot_manifest: "+err.Error())
+		os.Exit(1)
+	}
+}
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "usage: sdk_snapshot_manifest <staging-dir> <out-manifest.json> <version> <entry>...\n"+
+		"  where <entry> is either a staged file <dest-path>=<src-path>, or a contributing\n"+
+		"  module list \"module:<scope>=<module-name>,<module-name>...\"")
+	os.Exit(1)
+}
+
+// manifest is the structured record written to <out-manifest.json>, listing every path staged
+// under <staging-dir> and, per scope, the bootclasspath/system_server modules that contributed
+// to it, so downstream module SDK builds have one self-describing index of the snapshot's
+// contents and provenance instead of needing to know its directory layout or Android.bp up front.
+type manifest struct {
+	Version  string              `json:"version"`
+	Contents []string            `json:"contents"`
+	Modules  map[string][]string `json:"modules"`
+}
+
+// run copies each staged-file entry's src to stagingDir/dest, then writes a manifest enumerating
+// the dest paths and per-scope contributing modules (both sorted, so the manifest is
+// reproducible across runs) to manifestPath.
+func run(stagingDir, manifestPath, version string, entries []string) error {
+	var contents []string
+	modules := map[string][]string{}
+	for _, entry := range entries {
+		if rest, ok := strings.CutPrefix(entry, "module:"); ok {
+			scope, names, ok := strings.Cut(rest, "=")
+			if !ok {
+				return fmt.Errorf("malformed module entry %q: want module:<scope>=<module-name>,...", entry)
+			}
+			scopeNames := strings.Split(names, ",")
+			sort.Strings(scopeNames)
+			modules[scope] = append(modules[scope], scopeNames...)
+			continue
+		}
+		dest, src, ok := strings.Cut(entry, "=")
+		if !ok {
+			return fmt.Errorf("malformed entry %q: want <dest-path>=<src-path>", entry)
+		}
+		if err := stageFile(stagingDir, dest, src); err != nil {
+			return err
+		}
+		contents = append(contents, dest)
+	}
+	sort.Strings(contents)
+
+	out, err := json.MarshalIndent(manifest{Version: version, Contents: contents, Modules: modules}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(manifestPath, out, 0644)
+}
+
+// stageFile copies src to dest (itself relative to stagingDir), creating dest's parent
+// directories as needed.
+func stageFile(stagingDir, dest, src string) error {
+	destPath := filepath.Join(stagingDir, dest)
+	if err := os.MkdirAll(filepath.Dir(destPath), 0755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
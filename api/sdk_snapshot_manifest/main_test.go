@@ -0,0 +1,118 @@
+// Copyright (C) 2024 The Android Open Source Project
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunStagesFilesAndWritesManifest(t *testing.T) {
+	srcDir := t.TempDir()
+	stagingDir := t.TempDir()
+
+	currentTxt := filepath.Join(srcDir, "current.txt")
+	annotationsZip := filepath.Join(srcDir, "annotations.zip")
+	if err := os.WriteFile(currentTxt, []byte("method public void foo();\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(annotationsZip, []byte("not-really-a-zip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	manifestPath := filepath.Join(stagingDir, "manifest.json")
+	entries := []string{
+		"apistubs/android/public/api/current.txt=" + currentTxt,
+		"apistubs/android/public/annotations/annotations.zip=" + annotationsZip,
+	}
+	if err := run(stagingDir, manifestPath, "34", entries); err != nil {
+		t.Fatalf("run() failed: %v", err)
+	}
+
+	staged, err := os.ReadFile(filepath.Join(stagingDir, "apistubs/android/public/api/current.txt"))
+	if err != nil {
+		t.Fatalf("expected current.txt staged: %v", err)
+	}
+	if string(staged) != "method public void foo();\n" {
+		t.Errorf("staged current.txt contents changed: %q", staged)
+	}
+
+	manifestContents, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatalf("expected manifest written: %v", err)
+	}
+	want := `{
+  "version": "34",
+  "contents": [
+    "apistubs/android/public/annotations/annotations.zip",
+    "apistubs/android/public/api/current.txt"
+  ],
+  "modules": {}
+}`
+	if string(manifestContents) != want {
+		t.Errorf("manifest.json = %s, want %s", manifestContents, want)
+	}
+}
+
+func TestRunRecordsContributingModules(t *testing.T) {
+	stagingDir := t.TempDir()
+	manifestPath := filepath.Join(stagingDir, "manifest.json")
+
+	entries := []string{
+		"module:public=framework-location,framework-foo",
+		"module:system-server=framework-foo",
+	}
+	if err := run(stagingDir, manifestPath, "current", entries); err != nil {
+		t.Fatalf("run() failed: %v", err)
+	}
+
+	manifestContents, err := os.ReadFile(manifestPath)
+	if err != nil {
+		t.Fatalf("expected manifest written: %v", err)
+	}
+	want := `{
+  "version": "current",
+  "contents": null,
+  "modules": {
+    "public": [
+      "framework-foo",
+      "framework-location"
+    ],
+    "system-server": [
+      "framework-foo"
+    ]
+  }
+}`
+	if string(manifestContents) != want {
+		t.Errorf("manifest.json = %s, want %s", manifestContents, want)
+	}
+}
+
+func TestRunRejectsMalformedEntry(t *testing.T) {
+	stagingDir := t.TempDir()
+	err := run(stagingDir, filepath.Join(stagingDir, "manifest.json"), "current", []string{"no-equals-sign"})
+	if err == nil {
+		t.Fatal("expected an error for an entry with no '=', got nil")
+	}
+}
+
+func TestRunRejectsMalformedModuleEntry(t *testing.T) {
+	stagingDir := t.TempDir()
+	err := run(stagingDir, filepath.Join(stagingDir, "manifest.json"), "current", []string{"module:public-no-equals-sign"})
+	if err == nil {
+		t.Fatal("expected an error for a module entry with no '=', got nil")
+	}
+}